@@ -0,0 +1,154 @@
+// Package admin implements the /admin diagnostic surface: a registry of
+// in-flight /{userID} requests keyed by request ID, and the router that
+// exposes it (plus build info and pprof) on the internal admin listener.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry describes one in-flight /{userID} request.
+type Entry struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"userId"`
+	Route     string    `json:"route"`
+	Query     string    `json:"query"`
+	StartedAt time.Time `json:"startedAt"`
+	Elapsed   string    `json:"elapsed"`
+
+	cancel context.CancelFunc
+}
+
+// Registry tracks in-flight requests keyed by request ID, the same ID a
+// detailedError carries as its Id, so a hung query reported in the error
+// log can be looked up here and canceled.
+type Registry struct {
+	mu      sync.Mutex
+	entries map[string]*Entry
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{entries: make(map[string]*Entry)}
+}
+
+// Register adds an in-flight request to the registry and returns a func
+// that removes it; callers should defer the returned func so the entry is
+// cleared once the request completes, however it completes.
+func (r *Registry) Register(id, userID, route, query string, cancel context.CancelFunc) func() {
+	entry := &Entry{
+		ID:        id,
+		UserID:    userID,
+		Route:     route,
+		Query:     query,
+		StartedAt: time.Now(),
+		cancel:    cancel,
+	}
+
+	r.mu.Lock()
+	r.entries[id] = entry
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		delete(r.entries, id)
+		r.mu.Unlock()
+	}
+}
+
+// List returns a snapshot of all in-flight requests.
+func (r *Registry) List() []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]Entry, 0, len(r.entries))
+	for _, entry := range r.entries {
+		snapshot := *entry
+		snapshot.Elapsed = time.Since(entry.StartedAt).String()
+		out = append(out, snapshot)
+	}
+	return out
+}
+
+// Cancel aborts the in-flight request with the given id by canceling its
+// context, and reports whether such a request was found.
+func (r *Registry) Cancel(id string) bool {
+	r.mu.Lock()
+	entry, ok := r.entries[id]
+	r.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+	entry.cancel()
+	return true
+}
+
+// Info is the payload returned by GET /admin/info.
+type Info struct {
+	Version        string      `json:"version"`
+	Uptime         string      `json:"uptime"`
+	Goroutines     int         `json:"goroutines"`
+	Config         interface{} `json:"config"`
+	MongoPoolStats interface{} `json:"mongoPoolStats"`
+}
+
+// Router builds the /admin mux. authenticate gates every route and should
+// reject anything but a server-role token. mongoPoolStats is called fresh on
+// every /admin/info request; it may return nil if the storage client this
+// process was built with doesn't expose pool stats.
+func Router(registry *Registry, version string, started time.Time, redactedConfig interface{}, mongoPoolStats func() interface{}, authenticate func(*http.Request) bool) http.Handler {
+	mux := http.NewServeMux()
+
+	requireServer := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(res http.ResponseWriter, req *http.Request) {
+			if !authenticate(req) {
+				http.Error(res, "forbidden", http.StatusForbidden)
+				return
+			}
+			h(res, req)
+		}
+	}
+
+	mux.HandleFunc("/admin/info", requireServer(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(Info{
+			Version:        version,
+			Uptime:         time.Since(started).String(),
+			Goroutines:     runtime.NumGoroutine(),
+			Config:         redactedConfig,
+			MongoPoolStats: mongoPoolStats(),
+		})
+	}))
+
+	mux.HandleFunc("/admin/queries", requireServer(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(registry.List())
+	}))
+
+	mux.HandleFunc("/admin/queries/", requireServer(func(res http.ResponseWriter, req *http.Request) {
+		id := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/admin/queries/"), "/cancel")
+		if req.Method != http.MethodPost || !strings.HasSuffix(req.URL.Path, "/cancel") || id == "" {
+			http.NotFound(res, req)
+			return
+		}
+		if !registry.Cancel(id) {
+			http.Error(res, "no in-flight request with that id", http.StatusNotFound)
+			return
+		}
+		res.WriteHeader(http.StatusAccepted)
+	}))
+
+	mux.HandleFunc("/admin/profile/cpu", requireServer(pprof.Profile))
+	mux.HandleFunc("/admin/profile/heap", requireServer(pprof.Handler("heap").ServeHTTP))
+	mux.HandleFunc("/admin/profile/goroutine", requireServer(pprof.Handler("goroutine").ServeHTTP))
+
+	return mux
+}
@@ -0,0 +1,89 @@
+// Package metrics holds the Prometheus collectors for the data API, registered
+// in one place so registration calls aren't scattered around the codebase,
+// and a small helper for wiring them into the HTTP handlers.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// HandlerDuration tracks end-to-end handler latency, labeled by route and
+	// the response status code that was actually written.
+	HandlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tide_whisperer_handler_duration_seconds",
+		Help:    "Latency of HTTP handlers, labeled by route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "status"})
+
+	// ErrorsTotal counts detailedError responses, labeled by error code.
+	ErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tide_whisperer_errors_total",
+		Help: "Count of detailedError responses returned to clients, labeled by error code.",
+	}, []string{"code"})
+
+	// OpenCursors is the number of Mongo cursors currently open for streaming
+	// /{userID} responses.
+	OpenCursors = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tide_whisperer_open_mongo_cursors",
+		Help: "Number of Mongo cursors currently open for /{userID} streaming responses.",
+	})
+
+	// RecordsReturned is the distribution of record counts returned per
+	// /{userID} call.
+	RecordsReturned = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tide_whisperer_records_returned",
+		Help:    "Number of device-data records returned per /{userID} call.",
+		Buckets: []float64{0, 1, 10, 100, 1000, 10000, 100000},
+	})
+
+	// PreQueryDuration times the pre-query checks that run before streaming
+	// device data (Medtronic/Dexcom lookups), labeled by check name, so
+	// operators can see which one dominates request latency.
+	PreQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tide_whisperer_storage_prequery_duration_seconds",
+		Help:    "Latency of the pre-query storage checks, labeled by check.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"check"})
+)
+
+func init() {
+	prometheus.MustRegister(HandlerDuration, ErrorsTotal, OpenCursors, RecordsReturned, PreQueryDuration)
+}
+
+// statusRecorder wraps a ResponseWriter to capture the status code it was
+// given, defaulting to 200 since handlers are allowed to call Write without
+// ever calling WriteHeader. It forwards Flush so streaming NDJSON responses
+// keep working when wrapped.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Instrument wraps next so HandlerDuration is observed once the handler
+// returns, labeled with route and the status code it wrote.
+func Instrument(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: res, status: http.StatusOK}
+
+		next.ServeHTTP(rec, req)
+
+		HandlerDuration.WithLabelValues(route, strconv.Itoa(rec.status)).Observe(time.Since(start).Seconds())
+	})
+}
@@ -1,18 +1,22 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	httpgzip "github.com/daaku/go.httpgzip"
 	"github.com/gorilla/pat"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	uuid "github.com/satori/go.uuid"
 
 	common "github.com/tidepool-org/go-common"
@@ -22,10 +26,25 @@ import (
 	"github.com/tidepool-org/go-common/clients/mongo"
 	"github.com/tidepool-org/go-common/clients/shoreline"
 
+	"github.com/tidepool-org/tide-whisperer/admin"
 	"github.com/tidepool-org/tide-whisperer/auth"
+	"github.com/tidepool-org/tide-whisperer/logging"
+	"github.com/tidepool-org/tide-whisperer/metrics"
 	"github.com/tidepool-org/tide-whisperer/store"
 )
 
+// Version is the build version surfaced via GET /admin/info. Overridden at
+// build time with -ldflags "-X main.Version=...".
+var Version = "dev"
+
+// mongoPoolStatter is implemented by storage clients that can report Mongo
+// connection pool stats. store.NewMongoStoreClient's concrete type may or
+// may not satisfy it depending on the driver this tree is built against, so
+// /admin/info degrades to a nil field instead of failing when it doesn't.
+type mongoPoolStatter interface {
+	PoolStats() interface{}
+}
+
 type (
 	Config struct {
 		clients.Config
@@ -33,6 +52,18 @@ type (
 		Service             disc.ServiceListing `json:"service"`
 		Mongo               mongo.Config        `json:"mongo"`
 		store.SchemaVersion `json:"schemaVersion"`
+		// RequestTimeout bounds how long a single /{userID} query is allowed to
+		// run before it is aborted with a data_deadline_exceeded error. Zero
+		// means "use defaultRequestTimeout".
+		RequestTimeout time.Duration `json:"requestTimeout"`
+		// ShutdownTimeout bounds how long graceful shutdown waits for in-flight
+		// requests to finish before forcing the process down. Zero means "use
+		// defaultShutdownTimeout".
+		ShutdownTimeout time.Duration `json:"shutdownTimeout"`
+		// AdminAddr is the bind address for the internal admin listener that
+		// serves /metrics and the /admin diagnostics. It must not be the
+		// public data port. Empty means "use defaultAdminAddr".
+		AdminAddr string `json:"adminAddr"`
 	}
 
 	// so we can wrap and marshal the detailed error
@@ -56,6 +87,7 @@ var (
 	error_running_query      = detailedError{Status: http.StatusInternalServerError, Code: "data_store_error", Message: "internal server error"}
 	error_loading_events     = detailedError{Status: http.StatusInternalServerError, Code: "data_marshal_error", Message: "internal server error"}
 	error_invalid_parameters = detailedError{Status: http.StatusInternalServerError, Code: "invalid_parameters", Message: "one or more parameters are invalid"}
+	error_deadline_exceeded  = detailedError{Status: http.StatusGatewayTimeout, Code: "data_deadline_exceeded", Message: "the request took too long and was aborted"}
 
 	storage store.Storage
 )
@@ -63,15 +95,107 @@ var (
 const (
 	DATA_API_PREFIX           = "api/data"
 	MedtronicLoopBoundaryDate = "2017-09-01"
+
+	contentTypeJSON   = "application/json"
+	contentTypeNDJSON = "application/x-ndjson"
+
+	defaultRequestTimeout  = 5 * time.Minute
+	defaultShutdownTimeout = 30 * time.Second
+	defaultAdminAddr       = ":8081"
 )
 
+// shuttingDown flips to 1 once graceful shutdown begins, so /status?ready=1
+// can start failing before the listener actually stops, letting a load
+// balancer drain the pod ahead of the Mongo session closing underneath it.
+var shuttingDown int32
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// requestDeadline is a resettable watchdog for a single streamed response.
+// store.Storage has no context-aware variants yet, so a blocking
+// iterator.Next() can't be interrupted directly; instead we race it against
+// this timer in a select and close the cursor ourselves once it fires. It is
+// reset every time a document is produced, so on its own it only fires once
+// the stream stalls for the full timeout. The ctx handed to processResults
+// still caps the whole streaming phase at the same RequestTimeout.
+type requestDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	done   chan struct{}
+	expire sync.Once
+}
+
+func newRequestDeadline(d time.Duration) *requestDeadline {
+	rd := &requestDeadline{done: make(chan struct{})}
+	rd.timer = time.AfterFunc(d, rd.fire)
+	return rd
+}
+
+func (rd *requestDeadline) fire() {
+	rd.expire.Do(func() { close(rd.done) })
+}
+
+// reset pushes the deadline out by d, as if calling SetReadDeadline again.
+func (rd *requestDeadline) reset(d time.Duration) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	select {
+	case <-rd.done:
+		return
+	default:
+		rd.timer.Reset(d)
+	}
+}
+
+func (rd *requestDeadline) stop() {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.timer.Stop()
+}
+
+// wantsNDJSON decides the response encoding for a /{userID} request. The
+// `?format=ndjson` query param takes precedence over the `Accept` header so
+// that clients that can't set custom headers (e.g. a browser download link)
+// can still opt in; anything else falls back to the existing JSON array.
+func wantsNDJSON(req *http.Request) bool {
+	if format := req.URL.Query().Get("format"); format != "" {
+		return format == "ndjson"
+	}
+	for _, accept := range req.Header["Accept"] {
+		if strings.Contains(accept, contentTypeNDJSON) {
+			return true
+		}
+	}
+	return false
+}
+
 //set the intenal message that we will use for logging
 func (d detailedError) setInternalMessage(internal error) detailedError {
 	d.InternalMessage = internal.Error()
 	return d
 }
 
+// Error implements the error interface so a detailedError can be passed
+// straight to logging.RequestLogger.Error.
+func (d detailedError) Error() string {
+	return d.Message
+}
+
+// Fields implements logging.Fielder so a detailedError logs its structured
+// form automatically instead of being flattened into a formatted string.
+func (d detailedError) Fields() logging.Fields {
+	return logging.Fields{
+		"error_id":         d.Id,
+		"error_code":       d.Code,
+		"status":           d.Status,
+		"internal_message": d.InternalMessage,
+	}
+}
+
 func main() {
+	serviceStarted := time.Now()
 	var config Config
 
 	if err := common.LoadEnvironmentConfig(
@@ -81,6 +205,18 @@ func main() {
 		log.Fatal(DATA_API_PREFIX, " Problem loading config: ", err)
 	}
 
+	if config.RequestTimeout <= 0 {
+		config.RequestTimeout = defaultRequestTimeout
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if config.AdminAddr == "" {
+		config.AdminAddr = defaultAdminAddr
+	}
+
+	appLogger := logging.New(os.Stdout)
+
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
@@ -98,11 +234,6 @@ func main() {
 	if err := hakkenClient.Start(); err != nil {
 		log.Fatal(DATA_API_PREFIX, err)
 	}
-	defer func() {
-		if err := hakkenClient.Close(); err != nil {
-			log.Panic(DATA_API_PREFIX, "Error closing hakkenClient, panicing to get stacks: ", err)
-		}
-	}()
 
 	shorelineClient := shoreline.NewShorelineClientBuilder().
 		WithHostGetter(config.ShorelineConfig.ToHostGetter(hakkenClient)).
@@ -116,65 +247,181 @@ func main() {
 		WithTokenProvider(shorelineClient).
 		Build()
 
-	userCanViewData := func(authenticatedUserID string, targetUserID string) bool {
+	userCanViewData := func(reqLogger *logging.RequestLogger, authenticatedUserID string, targetUserID string) bool {
 		if authenticatedUserID == targetUserID {
 			return true
 		}
 
 		perms, err := gatekeeperClient.UserInGroup(authenticatedUserID, targetUserID)
 		if err != nil {
-			log.Println(DATA_API_PREFIX, "Error looking up user in group", err)
+			reqLogger.Error(error_no_permissons.setInternalMessage(err))
 			return false
 		}
 
-		log.Println(perms)
 		return !(perms["root"] == nil && perms["view"] == nil)
 	}
 
-	//log error detail and write as application/json
-	jsonError := func(res http.ResponseWriter, err detailedError, startedAt time.Time) {
+	//log error detail and write as application/json; returns the status
+	//written so callers can fold it into their own access-log record
+	jsonError := func(res http.ResponseWriter, req *http.Request, err detailedError, startedAt time.Time) int {
 
-		err.Id = uuid.NewV4().String()
+		if requestID := logging.FromContext(req.Context()).RequestID(); requestID != "" {
+			err.Id = requestID
+		} else {
+			err.Id = uuid.NewV4().String()
+		}
 
-		log.Println(DATA_API_PREFIX, fmt.Sprintf("[%s][%s] failed after [%.5f]secs with error [%s][%s] ", err.Id, err.Code, time.Now().Sub(startedAt).Seconds(), err.Message, err.InternalMessage))
+		metrics.ErrorsTotal.WithLabelValues(err.Code).Inc()
+		logging.FromContext(req.Context()).Error(err)
 
 		jsonErr, _ := json.Marshal(err)
 
 		res.Header().Add("content-type", "application/json")
 		res.WriteHeader(err.Status)
 		res.Write(jsonErr)
+
+		return err.Status
 	}
 
-	processResults := func(response http.ResponseWriter, iterator store.StorageIterator, startTime time.Time) {
+	// processResults streams iterator to response and returns the status the
+	// access log should record: http.StatusOK on a clean finish, or the
+	// status of the error that ended the stream. In NDJSON mode that error
+	// is appended to the stream as a trailing object; in JSON mode it is only
+	// logged and the array is closed as usual.
+	processResults := func(ctx context.Context, response http.ResponseWriter, req *http.Request, iterator store.StorageIterator, startTime time.Time) int {
 		var writeCount int
+		var timedOut bool
+
+		reqLogger := logging.FromContext(req.Context())
 
 		log.Printf("%s mongo processing started after %.5f seconds", DATA_API_PREFIX, time.Now().Sub(startTime).Seconds())
 
-		response.Header().Add("Content-Type", "application/json")
-		response.Write([]byte("["))
-
-		var results map[string]interface{}
-		for iterator.Next(&results) {
-			if len(results) > 0 {
-				if bytes, err := json.Marshal(results); err != nil {
-					log.Printf("%s failed to marshal mongo result with error: %s", DATA_API_PREFIX, err)
-				} else {
-					if writeCount > 0 {
-						response.Write([]byte(","))
+		ndjson := wantsNDJSON(req)
+		flusher, canFlush := response.(http.Flusher)
+
+		if ndjson {
+			response.Header().Add("Content-Type", contentTypeNDJSON)
+		} else {
+			response.Header().Add("Content-Type", contentTypeJSON)
+			response.Write([]byte("["))
+		}
+
+		deadline := newRequestDeadline(config.RequestTimeout)
+		defer deadline.stop()
+
+		type nextResult struct {
+			results map[string]interface{}
+			more    bool
+		}
+		// Buffered so the producer can hand off one result without waiting on
+		// us, but the buffer alone doesn't save us from leaking the goroutine:
+		// if we break out of the read loop on ctx.Done/deadline.done while a
+		// result is already sitting in the buffer, the producer's final send
+		// below would block forever. After a timeout we drain the channel to
+		// guarantee the producer exits.
+		nextCh := make(chan nextResult, 1)
+		go func() {
+			var results map[string]interface{}
+			for iterator.Next(&results) {
+				nextCh <- nextResult{results: results, more: true}
+				results = nil
+			}
+			nextCh <- nextResult{more: false}
+		}()
+
+	readLoop:
+		for {
+			select {
+			case next := <-nextCh:
+				if !next.more {
+					break readLoop
+				}
+				deadline.reset(config.RequestTimeout)
+				if len(next.results) > 0 {
+					if bytes, err := json.Marshal(next.results); err != nil {
+						reqLogger.Error(error_loading_events.setInternalMessage(err))
+					} else {
+						if ndjson {
+							response.Write(bytes)
+							response.Write([]byte("\n"))
+						} else {
+							if writeCount > 0 {
+								response.Write([]byte(","))
+							}
+							response.Write([]byte("\n"))
+							response.Write(bytes)
+						}
+						writeCount += 1
 					}
-					response.Write([]byte("\n"))
-					response.Write(bytes)
-					writeCount += 1
+				}
+				if ndjson && canFlush {
+					flusher.Flush()
+				}
+			case <-ctx.Done():
+				timedOut = true
+				break readLoop
+			case <-deadline.done:
+				timedOut = true
+				break readLoop
+			}
+		}
+
+		closeErr := iterator.Close()
+		if timedOut && closeErr == nil {
+			closeErr = ctx.Err()
+		}
+
+		// Closing the cursor unblocks a producer parked in iterator.Next(), so
+		// it can now reach its final send. But if we broke out of the loop
+		// while a result was still sitting in the buffered channel, that send
+		// would otherwise have no reader left and block forever. Drain until
+		// it reports it's done so the goroutine always exits.
+		if timedOut {
+			for next := range nextCh {
+				if !next.more {
+					break
 				}
 			}
 		}
 
-		if writeCount > 0 {
-			response.Write([]byte("\n"))
+		if ndjson {
+			if timedOut {
+				errDoc, _ := json.Marshal(error_deadline_exceeded)
+				response.Write(errDoc)
+				response.Write([]byte("\n"))
+			} else if closeErr != nil {
+				queryErr := error_running_query.setInternalMessage(closeErr)
+				reqLogger.Error(queryErr)
+				errDoc, _ := json.Marshal(queryErr)
+				response.Write(errDoc)
+				response.Write([]byte("\n"))
+			}
+			if canFlush {
+				flusher.Flush()
+			}
+		} else {
+			if timedOut {
+				reqLogger.Error(error_deadline_exceeded)
+			} else if closeErr != nil {
+				reqLogger.Error(error_running_query.setInternalMessage(closeErr))
+			}
+			if writeCount > 0 {
+				response.Write([]byte("\n"))
+			}
+			response.Write([]byte("]"))
 		}
-		response.Write([]byte("]"))
+
+		metrics.RecordsReturned.Observe(float64(writeCount))
 
 		log.Printf("%s mongo processing finished after %.5f seconds and returned %d records", DATA_API_PREFIX, time.Now().Sub(startTime).Seconds(), writeCount)
+
+		if timedOut {
+			return error_deadline_exceeded.Status
+		}
+		if closeErr != nil {
+			return error_running_query.Status
+		}
+		return http.StatusOK
 	}
 
 	if err := shorelineClient.Start(); err != nil {
@@ -183,17 +430,67 @@ func main() {
 
 	storage := store.NewMongoStoreClient(&config.Mongo)
 
+	var inFlightRequests sync.WaitGroup
+
+	requestRegistry := admin.NewRegistry()
+
+	authenticateAdmin := func(req *http.Request) bool {
+		sessionToken := req.Header.Get("x-tidepool-session-token")
+		if sessionToken == "" {
+			return false
+		}
+		td := shorelineClient.CheckToken(sessionToken)
+		return td != nil && td.IsServer
+	}
+
+	redactedConfig := map[string]interface{}{
+		"service":         config.Service,
+		"schemaVersion":   config.SchemaVersion,
+		"requestTimeout":  config.RequestTimeout.String(),
+		"shutdownTimeout": config.ShutdownTimeout.String(),
+		"adminAddr":       config.AdminAddr,
+		"mongo":           "redacted",
+		"auth":            "redacted",
+	}
+
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/metrics", promhttp.Handler())
+	mongoPoolStats := func() interface{} {
+		if statter, ok := storage.(mongoPoolStatter); ok {
+			return statter.PoolStats()
+		}
+		return nil
+	}
+	adminMux.Handle("/admin/", admin.Router(requestRegistry, Version, serviceStarted, redactedConfig, mongoPoolStats, authenticateAdmin))
+	go func() {
+		if err := http.ListenAndServe(config.AdminAddr, adminMux); err != nil {
+			log.Println(DATA_API_PREFIX, "admin listener stopped:", err)
+		}
+	}()
+
 	router := pat.New()
 
-	router.Add("GET", "/status", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+	router.Add("GET", "/status", metrics.Instrument("/status", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		start := time.Now()
+		req = req.WithContext(logging.NewContext(req.Context(), appLogger.WithRequest(uuid.NewV4().String(), "", "/status")))
+
+		status := http.StatusOK
+		defer func() {
+			logging.FromContext(req.Context()).Access(time.Now().Sub(start).Seconds()*1000, status)
+		}()
+
+		if req.URL.Query().Get("ready") == "1" && isShuttingDown() {
+			status = http.StatusServiceUnavailable
+			res.WriteHeader(status)
+			res.Write([]byte("shutting down\n"))
+			return
+		}
 		if err := storage.Ping(); err != nil {
-			jsonError(res, error_status_check.setInternalMessage(err), start)
+			status = jsonError(res, req, error_status_check.setInternalMessage(err), start)
 			return
 		}
 		res.Write([]byte("OK\n"))
-		return
-	}))
+	})))
 
 	// The /data/userId endpoint retrieves device/health data for a user based on a set of parameters
 	// userid: the ID of the user you want to retrieve data for
@@ -207,14 +504,30 @@ func main() {
 	//						  Must be in ISO date/time format e.g. 2015-10-10T15:00:00.000Z
 	// endDate (optional) : Only objects with 'time' field less than to or equal to start date will be returned .
 	//						  Must be in ISO date/time format e.g. 2015-10-10T15:00:00.000Z
-	router.Add("GET", "/{userID}", httpgzip.NewHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+	userDataHandler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		start := time.Now()
 
+		inFlightRequests.Add(1)
+		defer inFlightRequests.Done()
+
+		requestID := uuid.NewV4().String()
 		queryParams, err := store.GetParams(req.URL.Query(), &config.SchemaVersion)
 
+		userID := ""
+		if err == nil {
+			userID = queryParams.UserId
+		}
+		req = req.WithContext(logging.NewContext(req.Context(), appLogger.WithRequest(requestID, userID, "/{userID}")))
+
+		// One access-log record per request, however it ends: early
+		// rejection, a mid-query error, or a clean stream to completion.
+		status := http.StatusOK
+		defer func() {
+			logging.FromContext(req.Context()).Access(time.Now().Sub(start).Seconds()*1000, status)
+		}()
+
 		if err != nil {
-			log.Println(DATA_API_PREFIX, fmt.Sprintf("Error parsing date: %s", err))
-			jsonError(res, error_invalid_parameters, start)
+			status = jsonError(res, req, error_invalid_parameters.setInternalMessage(err), start)
 			return
 		}
 
@@ -228,42 +541,58 @@ func main() {
 			}
 		}
 
-		if td == nil || !(td.IsServer || td.UserID == queryParams.UserId || userCanViewData(td.UserID, queryParams.UserId)) {
-			jsonError(res, error_no_view_permisson, start)
+		if td == nil || !(td.IsServer || td.UserID == queryParams.UserId || userCanViewData(logging.FromContext(req.Context()), td.UserID, queryParams.UserId)) {
+			status = jsonError(res, req, error_no_view_permisson, start)
 			return
 		}
 
+		// store.Storage lives in a separate package this tree doesn't include,
+		// with no context-aware GetDeviceDataContext/HasMedtronicDirectDataContext/
+		// etc. variants to call, so the four pre-query checks below remain
+		// plain blocking Mongo calls: a client disconnect during one of them is
+		// only noticed once streaming starts, and the per-request deadline is
+		// only started after they all return. Only
+		// the streaming phase further down - which owns the cursor directly
+		// via iterator.Close() - can actually be aborted mid-flight today.
 		if _, ok := req.URL.Query()["carelink"]; !ok {
-			if hasMedtronicDirectData, medtronicErr := storage.HasMedtronicDirectData(queryParams.UserId); medtronicErr != nil {
-				log.Println(DATA_API_PREFIX, fmt.Sprintf("Error while querying for Medtronic Direct data: %s", medtronicErr))
-				jsonError(res, error_running_query, start)
+			preQueryStart := time.Now()
+			hasMedtronicDirectData, medtronicErr := storage.HasMedtronicDirectData(queryParams.UserId)
+			metrics.PreQueryDuration.WithLabelValues("has_medtronic_direct_data").Observe(time.Since(preQueryStart).Seconds())
+			if medtronicErr != nil {
+				status = jsonError(res, req, error_running_query.setInternalMessage(medtronicErr), start)
 				return
 			} else if !hasMedtronicDirectData {
 				queryParams.Carelink = true
 			}
 		}
 		if !queryParams.Dexcom {
-			if dexcomDataSource, dexcomErr := storage.GetDexcomDataSource(queryParams.UserId); dexcomErr != nil {
-				log.Println(DATA_API_PREFIX, fmt.Sprintf("Error while querying for Dexcom data source: %s", dexcomErr))
-				jsonError(res, error_running_query, start)
+			preQueryStart := time.Now()
+			dexcomDataSource, dexcomErr := storage.GetDexcomDataSource(queryParams.UserId)
+			metrics.PreQueryDuration.WithLabelValues("get_dexcom_data_source").Observe(time.Since(preQueryStart).Seconds())
+			if dexcomErr != nil {
+				status = jsonError(res, req, error_running_query.setInternalMessage(dexcomErr), start)
 				return
 			} else {
 				queryParams.DexcomDataSource = dexcomDataSource
 			}
 		}
 		if _, ok := req.URL.Query()["medtronic"]; !ok {
-			if hasMedtronicLoopData, medtronicErr := storage.HasMedtronicLoopDataAfter(queryParams.UserId, MedtronicLoopBoundaryDate); medtronicErr != nil {
-				log.Println(DATA_API_PREFIX, fmt.Sprintf("Error while querying for Medtronic Loop data: %s", medtronicErr))
-				jsonError(res, error_running_query, start)
+			preQueryStart := time.Now()
+			hasMedtronicLoopData, medtronicErr := storage.HasMedtronicLoopDataAfter(queryParams.UserId, MedtronicLoopBoundaryDate)
+			metrics.PreQueryDuration.WithLabelValues("has_medtronic_loop_data_after").Observe(time.Since(preQueryStart).Seconds())
+			if medtronicErr != nil {
+				status = jsonError(res, req, error_running_query.setInternalMessage(medtronicErr), start)
 				return
 			} else if !hasMedtronicLoopData {
 				queryParams.Medtronic = true
 			}
 		}
 		if !queryParams.Medtronic {
-			if medtronicUploadIds, medtronicErr := storage.GetLoopableMedtronicDirectUploadIdsAfter(queryParams.UserId, MedtronicLoopBoundaryDate); medtronicErr != nil {
-				log.Println(DATA_API_PREFIX, fmt.Sprintf("Error while querying for Loopable Medtronic Direct upload ids: %s", medtronicErr))
-				jsonError(res, error_running_query, start)
+			preQueryStart := time.Now()
+			medtronicUploadIds, medtronicErr := storage.GetLoopableMedtronicDirectUploadIdsAfter(queryParams.UserId, MedtronicLoopBoundaryDate)
+			metrics.PreQueryDuration.WithLabelValues("get_loopable_medtronic_direct_upload_ids_after").Observe(time.Since(preQueryStart).Seconds())
+			if medtronicErr != nil {
+				status = jsonError(res, req, error_running_query.setInternalMessage(medtronicErr), start)
 				return
 			} else {
 				queryParams.MedtronicDate = MedtronicLoopBoundaryDate
@@ -271,15 +600,38 @@ func main() {
 			}
 		}
 
+		// ctx/cancel bound the streaming phase below; requestRegistry lets
+		// /admin/queries/{id}/cancel abort it early via the same cancel func.
+		ctx, cancel := context.WithTimeout(req.Context(), config.RequestTimeout)
+		unregister := requestRegistry.Register(requestID, queryParams.UserId, "/{userID}", req.URL.RawQuery, cancel)
+		defer func() {
+			unregister()
+			cancel()
+		}()
+
 		started := time.Now()
 
+		metrics.OpenCursors.Inc()
 		iter := storage.GetDeviceData(queryParams)
-		defer iter.Close()
 
-		processResults(res, iter, started)
+		status = processResults(ctx, res, req, iter, started)
+		metrics.OpenCursors.Dec()
+	})
+
+	// httpgzip's ResponseWriter only implements io.Writer, not http.Flusher,
+	// so wrapping an NDJSON request in it would silently buffer every
+	// record instead of flushing it as produced - defeating the point of
+	// streaming. NDJSON requests bypass gzip entirely; everything else
+	// (the default JSON array response) is compressed as before.
+	gzippedUserDataHandler := httpgzip.NewHandler(userDataHandler)
+	router.Add("GET", "/{userID}", metrics.Instrument("/{userID}", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if wantsNDJSON(req) {
+			userDataHandler.ServeHTTP(res, req)
+			return
+		}
+		gzippedUserDataHandler.ServeHTTP(res, req)
 	})))
 
-	done := make(chan bool)
 	server := common.NewServer(&http.Server{
 		Addr:    config.Service.GetPort(),
 		Handler: router,
@@ -297,19 +649,44 @@ func main() {
 	}
 	hakkenClient.Publish(&config.Service)
 
-	signals := make(chan os.Signal, 40)
-	signal.Notify(signals)
-	go func() {
-		for {
-			sig := <-signals
-			log.Printf(DATA_API_PREFIX+" Got signal [%s]", sig)
+	signalCtx, stopNotify := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-signalCtx.Done()
+	stopNotify()
 
-			if sig == syscall.SIGINT || sig == syscall.SIGTERM {
-				server.Close()
-				done <- true
-			}
-		}
+	log.Println(DATA_API_PREFIX, "shutdown signal received, draining in-flight requests")
+	atomic.StoreInt32(&shuttingDown, 1)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer shutdownCancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println(DATA_API_PREFIX, "error shutting down HTTP server:", err)
+	}
+
+	// server.Shutdown can return as soon as shutdownCtx's deadline passes,
+	// even with handlers still streaming, so waiting on inFlightRequests
+	// unconditionally could hang past ShutdownTimeout. Gate it on the same
+	// deadline instead of trusting it to return promptly on its own.
+	drained := make(chan struct{})
+	go func() {
+		inFlightRequests.Wait()
+		close(drained)
 	}()
+	select {
+	case <-drained:
+	case <-shutdownCtx.Done():
+		log.Println(DATA_API_PREFIX, "shutdown timeout reached before all in-flight requests drained")
+	}
+
+	if err := hakkenClient.Close(); err != nil {
+		log.Println(DATA_API_PREFIX, "error closing hakken client:", err)
+	}
+	if err := shorelineClient.Close(); err != nil {
+		log.Println(DATA_API_PREFIX, "error closing shoreline client:", err)
+	}
+	if err := storage.Close(); err != nil {
+		log.Println(DATA_API_PREFIX, "error closing mongo session:", err)
+	}
 
-	<-done
+	log.Println(DATA_API_PREFIX, "shutdown complete")
 }